@@ -1,10 +1,11 @@
-/*Copyright [2019] housepower
+/*
+Copyright [2019] housepower
 
 Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
 You may obtain a copy of the License at
 
-   http://www.apache.org/licenses/LICENSE-2.0
+	http://www.apache.org/licenses/LICENSE-2.0
 
 Unless required by applicable law or agreed to in writing, software
 distributed under the License is distributed on an "AS IS" BASIS,
@@ -18,6 +19,7 @@ import (
 	"bytes"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"regexp"
 	"strconv"
 	"sync"
@@ -40,105 +42,238 @@ type CsvParser struct {
 // Parse extract a list of comma-separated values from the data
 func (p *CsvParser) Parse(bs []byte) (metric model.Metric, err error) {
 	r := csv.NewReader(bytes.NewReader(bs))
-	r.FieldsPerRecord = len(p.pp.csvFormat)
 	if len(p.pp.delimiter) > 0 {
 		r.Comma = rune(p.pp.delimiter[0])
 	}
+	// When csvFormat isn't statically configured (csvHasHeader is set), the
+	// first records are treated as skip rows followed by the header row, and
+	// are consumed to derive csvFormat instead of producing a metric.
+	if p.pp.csvHasHeader && !p.pp.headerKnown() {
+		if p.pp.skipRow() {
+			err = ErrCsvHeaderConsumed
+			return
+		}
+		var header []string
+		if header, err = r.Read(); err != nil {
+			err = errors.Wrap(err, "failed to read csv header")
+			return
+		}
+		p.pp.buildCsvFormat(header)
+		err = ErrCsvHeaderConsumed
+		return
+	}
+	format := p.pp.getCsvFormat()
+	r.FieldsPerRecord = len(format)
 	var value []string
 	if value, err = r.Read(); err != nil {
 		err = errors.Wrap(err, "")
 		return
 	}
-	if len(value) != len(p.pp.csvFormat) {
+	if len(value) != len(format) {
 		err = errors.Errorf("csv value doesn't match the format")
 		return
 	}
-	metric = &CsvMetric{p.pp, value}
+	if err = p.pp.validateDecoders(value); err != nil {
+		return
+	}
+	metric = &CsvMetric{pp: p.pp, values: value}
 	return
 }
 
+// ParseAll streams every row out of bs, reusing a single csv.Reader instead
+// of constructing one per call. This lets one Kafka message carry many rows
+// (common with log-shipper producers) without paying Parse's per-row Reader
+// setup cost.
+//
+// This stops short of zero-allocation: r.ReuseRecord avoids a []string churn
+// per row, but each row is still copied into its own slice below so the
+// CsvMetric handed back to the caller isn't aliased to the reader's reused
+// buffer (or to another row's metric). A true zero-allocation path would
+// need the caller to consume/release each metric before the next Read,
+// which the current model.Metric contract doesn't support.
+func (p *CsvParser) ParseAll(bs []byte) (metrics []model.Metric, err error) {
+	r := csv.NewReader(bytes.NewReader(bs))
+	r.ReuseRecord = true
+	if len(p.pp.delimiter) > 0 {
+		r.Comma = rune(p.pp.delimiter[0])
+	}
+	for {
+		var value []string
+		if value, err = r.Read(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if p.pp.csvHasHeader && !p.pp.headerKnown() {
+			if p.pp.skipRow() {
+				continue
+			}
+			p.pp.buildCsvFormat(value)
+			continue
+		}
+		if len(value) != len(p.pp.getCsvFormat()) {
+			err = errors.Errorf("csv value doesn't match the format")
+			return
+		}
+		if err = p.pp.validateDecoders(value); err != nil {
+			return
+		}
+		// r.ReuseRecord means value is overwritten by the next Read, so each
+		// metric needs its own copy to outlive this loop.
+		record := make([]string, len(value))
+		copy(record, value)
+		metrics = append(metrics, &CsvMetric{pp: p.pp, values: record})
+	}
+}
+
 // CsvMetic
 type CsvMetric struct {
-	pp     *Pool
-	values []string
+	pp        *Pool
+	values    []string
+	decodeErr error
+}
+
+// Error returns the first error a FieldDecoder reported from a Get* call on
+// this row, or nil if none did. A decoder for a column declared with
+// Pool.DeclareColumn is already validated earlier, by Parse/ParseAll's own
+// error return (see Pool.validateDecoders); this only covers decoders on
+// undeclared columns, which Pool has no way to check before Get* is called.
+func (c *CsvMetric) Error() error {
+	return c.decodeErr
+}
+
+func (c *CsvMetric) recordDecodeErr(key string, err error) {
+	if c.decodeErr == nil {
+		c.decodeErr = errors.Wrapf(err, "field decoder failed for %q", key)
+	}
+}
+
+// rawValue returns the unparsed field for key, and whether key is a known
+// column.
+func (c *CsvMetric) rawValue(key string) (raw string, ok bool) {
+	idx, ok := c.pp.getCsvFormat()[key]
+	if !ok {
+		return "", false
+	}
+	return c.values[idx], true
 }
 
 // GetString get the value as string
 func (c *CsvMetric) GetString(key string, nullable bool) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+	raw, ok := c.rawValue(key)
+	if !ok || raw == "null" {
 		if nullable {
 			return
 		}
 		val = ""
 		return
 	}
-	val = c.values[idx]
+	if dv, handled, err := c.pp.decodeField(key, TypeString, raw, nullable); handled {
+		if err != nil {
+			c.recordDecodeErr(key, err)
+			val = ""
+			return
+		}
+		val = dv
+		return
+	}
+	val = raw
 	return
 }
 
 // GetFloat returns the value as float
 func (c *CsvMetric) GetFloat(key string, nullable bool) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+	raw, ok := c.rawValue(key)
+	if !ok || raw == "null" {
 		if nullable {
 			return
 		}
 		val = float64(0.0)
 		return
 	}
-	val = fastfloat.ParseBestEffort(c.values[idx])
+	if dv, handled, err := c.pp.decodeField(key, TypeFloat, raw, nullable); handled {
+		if err != nil {
+			c.recordDecodeErr(key, err)
+			val = float64(0.0)
+			return
+		}
+		val = dv
+		return
+	}
+	val = fastfloat.ParseBestEffort(raw)
 	return
 }
 
 func (c *CsvMetric) GetBool(key string, nullable bool) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "" || c.values[idx] == "null" {
+	raw, ok := c.rawValue(key)
+	if !ok || raw == "" || raw == "null" {
 		if nullable {
 			return
 		}
 		val = false
 		return
 	}
-	val = (c.values[idx] == "true")
+	if dv, handled, err := c.pp.decodeField(key, TypeBool, raw, nullable); handled {
+		if err != nil {
+			c.recordDecodeErr(key, err)
+			val = false
+			return
+		}
+		val = dv
+		return
+	}
+	val = (raw == "true")
 	return
 }
 
 func (c *CsvMetric) GetInt(key string, nullable bool) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+	raw, ok := c.rawValue(key)
+	if !ok || raw == "null" {
 		if nullable {
 			return
 		}
 		val = int64(0)
 		return
 	}
-	if s := c.values[idx]; s == "true" {
+	if dv, handled, err := c.pp.decodeField(key, TypeInt, raw, nullable); handled {
+		if err != nil {
+			c.recordDecodeErr(key, err)
+			val = int64(0)
+			return
+		}
+		val = dv
+		return
+	}
+	if raw == "true" {
 		val = int64(1)
 	} else {
-		val = fastfloat.ParseInt64BestEffort(s)
+		val = fastfloat.ParseInt64BestEffort(raw)
 	}
 	return
 }
 
 func (c *CsvMetric) GetDateTime(key string, nullable bool) (val interface{}) {
-	var idx int
-	var ok bool
-	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+	raw, ok := c.rawValue(key)
+	if !ok || raw == "null" {
 		if nullable {
 			return
 		}
 		val = Epoch
 		return
 	}
-	s := c.values[idx]
-	if dd, err := strconv.ParseFloat(s, 64); err != nil {
-		var err error
-		if val, err = c.pp.ParseDateTime(key, s); err != nil {
+	if dv, handled, err := c.pp.decodeField(key, TypeDateTime, raw, nullable); handled {
+		if err != nil {
+			c.recordDecodeErr(key, err)
+			val = Epoch
+			return
+		}
+		val = dv
+		return
+	}
+	if dd, err := strconv.ParseFloat(raw, 64); err != nil {
+		var perr error
+		if val, perr = c.pp.ParseDateTime(key, raw); perr != nil {
 			val = Epoch
 		}
 	} else {
@@ -157,6 +292,17 @@ func (c *CsvMetric) GetElasticDateTime(key string, nullable bool) (val interface
 
 // GetArray parse an CSV encoded array
 func (c *CsvMetric) GetArray(key string, typ int) (val interface{}) {
+	if raw, ok := c.rawValue(key); ok && raw != "" && raw != "null" {
+		if dv, handled, err := c.pp.decodeField(key, TypeArray, raw, false); handled {
+			if err != nil {
+				c.recordDecodeErr(key, err)
+				val = makeArray(typ)
+				return
+			}
+			val = dv
+			return
+		}
+	}
 	s := c.GetString(key, false)
 	str, _ := s.(string)
 	if str == "" || str[0] != '[' {
@@ -0,0 +1,364 @@
+/*
+Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/pkg/errors"
+)
+
+// Epoch is the zero-value datetime used when a field can't be parsed.
+var Epoch = time.Unix(0, 0)
+
+// Parser abstracts the various supported wire formats (csv, json, ...).
+type Parser interface {
+	// Parse extracts a single model.Metric out of one input message.
+	Parse(bs []byte) (metric model.Metric, err error)
+	// ParseAll extracts every model.Metric contained in one input message.
+	// Most formats carry exactly one metric per message and can implement
+	// this as `return ParseAllFromParse(p, bs)`; CsvParser overrides it with
+	// a real streaming implementation so one message can carry many rows.
+	ParseAll(bs []byte) (metrics []model.Metric, err error)
+}
+
+// ParseAllFromParse is the default ParseAll implementation for parsers that
+// only ever produce one metric per message; it just wraps Parse. Go has no
+// default interface methods, so parsers call this directly from their own
+// ParseAll instead of getting it for free.
+func ParseAllFromParse(p Parser, bs []byte) (metrics []model.Metric, err error) {
+	var metric model.Metric
+	if metric, err = p.Parse(bs); err != nil {
+		return
+	}
+	metrics = []model.Metric{metric}
+	return
+}
+
+// ErrCsvHeaderConsumed is returned by CsvParser.Parse when the given bytes were
+// consumed as the CSV header (or a skipped leading row) instead of a data row.
+// Callers should drop the message and continue without treating this as a
+// parse failure.
+var ErrCsvHeaderConsumed = errors.New("csv header row consumed, no metric produced")
+
+// Pool holds the per-task parser configuration and state shared by all
+// CsvParser/CsvMetric instances handed out for that task. A Pool is reused
+// across many goroutines, so any state it lazily derives (such as the CSV
+// header) must be built exactly once and published safely for concurrent
+// readers.
+type Pool struct {
+	csvFormat atomic.Value // holds map[string]int; unset (Load returns nil) until known
+	delimiter string
+	timeUnit  float64
+	layout    string
+
+	// csvHasHeader, when set, tells CsvParser to derive csvFormat from the
+	// first CSV record it sees instead of requiring it in config.
+	csvHasHeader bool
+	// csvSkipRows is the number of leading rows (e.g. comment lines) to
+	// discard before the header row is read.
+	csvSkipRows int
+	// csvHeaderMap renames header column names to the ClickHouse column
+	// names expected by csvFormat. Header names absent from the map are
+	// used as-is.
+	csvHeaderMap map[string]string
+
+	// headerMu serializes the header bootstrap (read-header, build
+	// csvFormat) so concurrent Parse/ParseAll callers on a fresh Pool don't
+	// race each other into building it. It only decides which goroutine
+	// performs the build, not which record is treated as the header - see
+	// buildCsvFormat for why that still matters.
+	headerMu   sync.Mutex
+	rowsToSkip int32 // atomic count of leading rows skipped so far, up to csvSkipRows
+
+	decoderMu      sync.RWMutex
+	fieldDecoders  map[string]FieldDecoder // column name -> decoder
+	typeDecoders   map[string]FieldDecoder // Type* constant -> decoder
+	columnTypes    map[string]string       // column name -> Type* constant, from DeclareColumn
+	columnNullable map[string]bool         // column name -> nullable, from DeclareColumn
+}
+
+// FieldDecoder converts a raw field value into the representation expected
+// by model.Metric getters. Unlike the built-in parsing (which silently falls
+// back to zero values, e.g. Epoch for a bad datetime), a registered decoder
+// returning an error is surfaced through Parse/ParseAll's own error return
+// for any column declared with DeclareColumn, since that gives Pool enough
+// information (type, nullability) to validate it exactly as the matching
+// Get* call would. Errors from decoders on undeclared columns are only
+// discoverable later, via CsvMetric.Error.
+type FieldDecoder func(raw string, nullable bool) (interface{}, error)
+
+// DeclareColumn tells Pool the type and nullability a column will be read
+// with (one of the Type* constants, matching the destination ClickHouse
+// column), so Parse/ParseAll can eagerly validate any decoder registered for
+// it with exactly the null-handling and nullable semantics the matching
+// Get* call uses. Columns never declared are only checked lazily, the first
+// time a Get* call reaches their decoder (see CsvMetric.Error).
+func (pp *Pool) DeclareColumn(column, typeName string, nullable bool) {
+	pp.decoderMu.Lock()
+	defer pp.decoderMu.Unlock()
+	if pp.columnTypes == nil {
+		pp.columnTypes = make(map[string]string)
+		pp.columnNullable = make(map[string]bool)
+	}
+	pp.columnTypes[column] = typeName
+	pp.columnNullable[column] = nullable
+}
+
+// Built-in type names usable with RegisterTypeDecoder.
+const (
+	TypeString   = "string"
+	TypeInt      = "int"
+	TypeFloat    = "float"
+	TypeBool     = "bool"
+	TypeDateTime = "datetime"
+	TypeArray    = "array"
+)
+
+// RegisterFieldDecoder installs dec as the decoder for column, taking
+// precedence over any type decoder and over the built-in parsing.
+func (pp *Pool) RegisterFieldDecoder(column string, dec FieldDecoder) {
+	pp.decoderMu.Lock()
+	defer pp.decoderMu.Unlock()
+	if pp.fieldDecoders == nil {
+		pp.fieldDecoders = make(map[string]FieldDecoder)
+	}
+	pp.fieldDecoders[column] = dec
+}
+
+// RegisterTypeDecoder installs dec as the decoder for every column accessed
+// via the given type (one of the Type* constants), unless a column has a
+// more specific decoder registered with RegisterFieldDecoder.
+func (pp *Pool) RegisterTypeDecoder(typeName string, dec FieldDecoder) {
+	pp.decoderMu.Lock()
+	defer pp.decoderMu.Unlock()
+	if pp.typeDecoders == nil {
+		pp.typeDecoders = make(map[string]FieldDecoder)
+	}
+	pp.typeDecoders[typeName] = dec
+}
+
+// decodeField looks up a decoder for column, by name then by type, and runs
+// it against raw. ok is false when no decoder applies, telling the caller to
+// fall back to its built-in parsing.
+func (pp *Pool) decodeField(column, typeName, raw string, nullable bool) (val interface{}, ok bool, err error) {
+	pp.decoderMu.RLock()
+	dec, found := pp.fieldDecoders[column]
+	if !found {
+		dec, found = pp.typeDecoders[typeName]
+	}
+	pp.decoderMu.RUnlock()
+	if !found {
+		return nil, false, nil
+	}
+	val, err = dec(raw, nullable)
+	return val, true, err
+}
+
+// validateDecoders eagerly runs the decoder for every declared column
+// (DeclareColumn) against values (indexed per csvFormat), using exactly the
+// lookup, null-handling and nullable semantics CsvMetric's Get* methods use
+// for that column - so declaring a column and getting an error back from
+// Parse/ParseAll never disagrees with what the matching Get* call would have
+// done. Columns that were never declared aren't checked here at all; their
+// decoder (if any) only runs lazily, the first time a Get* call reaches it
+// (see CsvMetric.Error).
+func (pp *Pool) validateDecoders(values []string) error {
+	pp.decoderMu.RLock()
+	defer pp.decoderMu.RUnlock()
+	if len(pp.columnTypes) == 0 {
+		return nil
+	}
+	format := pp.getCsvFormat()
+	for column, typeName := range pp.columnTypes {
+		idx, ok := format[column]
+		if !ok {
+			continue
+		}
+		raw := values[idx]
+		// Every CsvMetric Get* method short-circuits on a "null" raw value
+		// before ever consulting a decoder; mirror that here so a NOT-NULL
+		// decoder never sees (and can't reject) a value the read path would
+		// have quietly substituted a zero value for.
+		if raw == "null" {
+			continue
+		}
+		// GetBool and GetArray also short-circuit on an empty raw value, and
+		// GetArray always calls its decoder with nullable=false.
+		if raw == "" && (typeName == TypeBool || typeName == TypeArray) {
+			continue
+		}
+		nullable := pp.columnNullable[column]
+		if typeName == TypeArray {
+			nullable = false
+		}
+		dec, found := pp.fieldDecoders[column]
+		if !found {
+			dec, found = pp.typeDecoders[typeName]
+		}
+		if !found {
+			continue
+		}
+		if _, err := dec(raw, nullable); err != nil {
+			return errors.Wrapf(err, "field decoder failed for %q", column)
+		}
+	}
+	return nil
+}
+
+// NewPool creates a Pool for a static, fully-specified csvFormat. It never
+// enables the header-driven behavior; NewHeaderPool does.
+func NewPool(csvFormat map[string]int, delimiter string, timeUnit float64, layout string) *Pool {
+	pp := &Pool{
+		delimiter: delimiter,
+		timeUnit:  timeUnit,
+		layout:    layout,
+	}
+	if csvFormat != nil {
+		pp.csvFormat.Store(csvFormat)
+	}
+	return pp
+}
+
+// NewHeaderPool creates a Pool that derives csvFormat from the CSV header
+// row instead of a statically-configured one. skipRows leading rows (e.g.
+// comment lines) are discarded before the header row is read. headerMap
+// renames header column names to the ClickHouse column names expected by
+// csvFormat; header names absent from it are used as-is. Pass a nil
+// headerMap if no renaming is needed.
+func NewHeaderPool(delimiter string, timeUnit float64, layout string, skipRows int, headerMap map[string]string) *Pool {
+	return &Pool{
+		delimiter:    delimiter,
+		timeUnit:     timeUnit,
+		layout:       layout,
+		csvHasHeader: true,
+		csvSkipRows:  skipRows,
+		csvHeaderMap: headerMap,
+	}
+}
+
+// getCsvFormat returns the derived column->index map, or nil if it hasn't
+// been built yet. atomic.Value.Load/Store gives every reader a proper
+// happens-before relationship with the goroutine that called Store, so a
+// map built by buildCsvFormat is always seen fully formed - never torn or
+// racy - by callers that go through this accessor.
+func (pp *Pool) getCsvFormat() map[string]int {
+	v := pp.csvFormat.Load()
+	if v == nil {
+		return nil
+	}
+	return v.(map[string]int)
+}
+
+// headerKnown reports whether csvFormat has already been derived.
+func (pp *Pool) headerKnown() bool {
+	return pp.getCsvFormat() != nil
+}
+
+// skipRow consumes one leading row, if csvSkipRows hasn't been exhausted yet.
+func (pp *Pool) skipRow() bool {
+	if pp.csvSkipRows == 0 {
+		return false
+	}
+	for {
+		n := atomic.LoadInt32(&pp.rowsToSkip)
+		want := int32(pp.csvSkipRows)
+		if n >= want {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&pp.rowsToSkip, n, n+1) {
+			return true
+		}
+	}
+}
+
+// buildCsvFormat derives csvFormat from a CSV header row and publishes it
+// via atomic.Value, applying csvHeaderMap renames. headerMu ensures only one
+// goroutine ever performs the build even if several call this concurrently
+// on a fresh Pool.
+//
+// headerMu only serializes *which goroutine* does the work, not *which
+// record* is the header: it guarantees the first caller to take the lock
+// wins, not that that caller was handed the actual header row. Correctness
+// therefore depends on the input pipeline guaranteeing the header is the
+// first record this Pool ever sees - e.g. by reading the header row
+// single-threaded before fanning out concurrent Parse/ParseAll workers.
+// Pools fed from multiple partitions/workers without that ordering guarantee
+// must not rely on header-derived csvFormat; configure csvFormat statically
+// instead.
+func (pp *Pool) buildCsvFormat(header []string) {
+	if pp.headerKnown() {
+		return
+	}
+	pp.headerMu.Lock()
+	defer pp.headerMu.Unlock()
+	if pp.headerKnown() {
+		return
+	}
+	format := make(map[string]int, len(header))
+	for i, name := range header {
+		if renamed, ok := pp.csvHeaderMap[name]; ok {
+			name = renamed
+		}
+		format[name] = i
+	}
+	pp.csvFormat.Store(format)
+}
+
+// ParseDateTime parses s using the Pool-wide layout (RFC3339 if unset). The
+// same layout applies to every column; key is only used in the error message.
+func (pp *Pool) ParseDateTime(key, s string) (t time.Time, err error) {
+	layout := pp.layout
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	if t, err = time.Parse(layout, s); err != nil {
+		err = errors.Wrapf(err, "failed to parse datetime %q for field %q", s, key)
+	}
+	return
+}
+
+// UnixFloat converts a unix timestamp expressed in timeUnit-sized ticks
+// (e.g. timeUnit=1e3 for milliseconds) to a time.Time.
+func UnixFloat(v float64, timeUnit float64) time.Time {
+	if timeUnit <= 0 {
+		timeUnit = 1
+	}
+	sec := v / timeUnit
+	whole := int64(sec)
+	return time.Unix(whole, int64((sec-float64(whole))*float64(time.Second)))
+}
+
+// makeArray returns the zero-value slice for the given model array type.
+func makeArray(typ int) interface{} {
+	switch typ {
+	case model.Bool:
+		return []bool{}
+	case model.Int:
+		return []int64{}
+	case model.Float:
+		return []float64{}
+	case model.String:
+		return []string{}
+	case model.DateTime:
+		return []time.Time{}
+	default:
+		return nil
+	}
+}